@@ -0,0 +1,147 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestAuthSettings builds an authSettings with a token authenticator
+// loaded from a one-line token file, for exercising AuthnInterceptor
+// against a real server without a real --token-file flag.
+func newTestAuthSettings(t *testing.T, tokenLine string) authSettings {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens")
+	require.NoError(t, os.WriteFile(path, []byte(tokenLine+"\n"), 0644))
+
+	tok, err := NewReloadableTokenAuthenticator(path)
+	require.NoError(t, err)
+
+	return authSettings{tokenAuthenticator: tok}
+}
+
+// serveHealthWithInterceptors starts a real grpc.Server, registering the
+// standard health service, with unary and stream interceptors installed
+// exactly as ServerArgs wires them in main.go, and returns a client dialed
+// to it over bufconn.
+func serveHealthWithInterceptors(t *testing.T, unary grpc.UnaryServerInterceptor, stream grpc.StreamServerInterceptor) healthpb.HealthClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(unary), grpc.StreamInterceptor(stream))
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthSrv)
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	return healthpb.NewHealthClient(dialBufconn(t, lis))
+}
+
+// TestAuthnInterceptorAllowsCallsWhenNoAuthConfigured confirms the zero
+// authSettings (the server's default, unauthenticated, mode) doesn't
+// reject a caller that presents no credentials at all.
+func TestAuthnInterceptorAllowsCallsWhenNoAuthConfigured(t *testing.T) {
+	s := authSettings{}
+	client := serveHealthWithInterceptors(t, AuthnInterceptor(s), StreamAuthnInterceptor(s))
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+}
+
+// TestAuthnInterceptorRejectsUnauthenticatedCall is the end-to-end proof
+// the earlier diff was missing: with a token authenticator configured,
+// a real gRPC call presenting no credentials is rejected by the real
+// grpc.Server, not just by a unit test of the token authenticator itself.
+func TestAuthnInterceptorRejectsUnauthenticatedCall(t *testing.T) {
+	s := newTestAuthSettings(t, "abc123 alice")
+	client := serveHealthWithInterceptors(t, AuthnInterceptor(s), StreamAuthnInterceptor(s))
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Error(t, err)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// TestAuthnInterceptorAllowsValidBearerToken confirms a caller presenting
+// a valid token in the "authorization: Bearer <token>" metadata entry is
+// let through the real server.
+func TestAuthnInterceptorAllowsValidBearerToken(t *testing.T) {
+	s := newTestAuthSettings(t, "abc123 alice")
+	client := serveHealthWithInterceptors(t, AuthnInterceptor(s), StreamAuthnInterceptor(s))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer abc123")
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+}
+
+// TestAuthnInterceptorRejectsInvalidBearerToken confirms a caller
+// presenting a token that doesn't match any configured identity is still
+// rejected, rather than falling through to an anonymous identity.
+func TestAuthnInterceptorRejectsInvalidBearerToken(t *testing.T) {
+	s := newTestAuthSettings(t, "abc123 alice")
+	client := serveHealthWithInterceptors(t, AuthnInterceptor(s), StreamAuthnInterceptor(s))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong-token")
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.Error(t, err)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// TestStreamAuthnInterceptorRejectsUnauthenticatedCall is the streaming
+// counterpart of TestAuthnInterceptorRejectsUnauthenticatedCall, exercised
+// against the health service's streaming Watch RPC.
+func TestStreamAuthnInterceptorRejectsUnauthenticatedCall(t *testing.T) {
+	s := newTestAuthSettings(t, "abc123 alice")
+	client := serveHealthWithInterceptors(t, AuthnInterceptor(s), StreamAuthnInterceptor(s))
+
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.Error(t, err)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// TestAuthenticateIncomingAttachesIdentity verifies that a successfully
+// authenticated call's Identity is retrievable via IdentityFromContext,
+// which is how the per-repo Authorizer check downstream (done once the
+// RPC's repo path is known) is meant to look it up.
+func TestAuthenticateIncomingAttachesIdentity(t *testing.T) {
+	s := newTestAuthSettings(t, "abc123 alice admins")
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer abc123"))
+	authedCtx, err := authenticateIncoming(ctx, s)
+	require.NoError(t, err)
+
+	id, ok := IdentityFromContext(authedCtx)
+	require.True(t, ok)
+	assert.Equal(t, "alice", id.Subject)
+	assert.Equal(t, []string{"admins"}, id.Groups)
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCertWithCN builds a minimal self-signed certificate with the
+// given common name, suitable for exercising CertCNAuthenticator without a
+// real mTLS handshake.
+func selfSignedCertWithCN(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens")
+	require.NoError(t, os.WriteFile(path, []byte(
+		"# comment\nabc123 alice admins,readers\nxyz789 bob\n",
+	), 0644))
+
+	a, err := LoadStaticTokenAuthenticator(path)
+	require.NoError(t, err)
+
+	id, ok := a.Authenticate("abc123")
+	require.True(t, ok)
+	assert.Equal(t, "alice", id.Subject)
+	assert.Equal(t, []string{"admins", "readers"}, id.Groups)
+
+	id, ok = a.Authenticate("xyz789")
+	require.True(t, ok)
+	assert.Equal(t, "bob", id.Subject)
+	assert.Empty(t, id.Groups)
+
+	_, ok = a.Authenticate("nope")
+	assert.False(t, ok)
+}
+
+func TestYAMLACL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+rules:
+  - subject: ci-bot
+    permission: write
+  - group: readers
+    permission: read
+  - repo_prefix: "public"
+    permission: read
+`), 0644))
+
+	acl, err := LoadYAMLACL(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, PermissionWrite, acl.Authorize(Identity{Subject: "ci-bot"}, "someorg/somerepo"))
+	assert.Equal(t, PermissionRead, acl.Authorize(Identity{Subject: "carol", Groups: []string{"readers"}}, "someorg/somerepo"))
+	assert.Equal(t, PermissionRead, acl.Authorize(Identity{Subject: "anonymous"}, "public/docs"))
+	assert.Equal(t, PermissionNone, acl.Authorize(Identity{Subject: "anonymous"}, "private/secret"))
+
+	// A repo_prefix rule must match a whole path segment, not just a
+	// string prefix: "public-other" and "publicity" merely start with the
+	// same characters as "public" but aren't under it.
+	assert.Equal(t, PermissionNone, acl.Authorize(Identity{Subject: "anonymous"}, "public-other/x"))
+	assert.Equal(t, PermissionNone, acl.Authorize(Identity{Subject: "anonymous"}, "publicity/x"))
+	assert.Equal(t, PermissionNone, acl.Authorize(Identity{Subject: "anonymous"}, "public2/secret"))
+	assert.Equal(t, PermissionRead, acl.Authorize(Identity{Subject: "anonymous"}, "public"))
+}
+
+func TestYAMLACLRejectsBadPermission(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n  - subject: bob\n    permission: admin\n"), 0644))
+
+	_, err := LoadYAMLACL(path)
+	require.Error(t, err)
+}
+
+func TestReloadableAuthorizerReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n  - subject: bob\n    permission: read\n"), 0644))
+
+	r, err := NewReloadableAuthorizer(path)
+	require.NoError(t, err)
+	assert.Equal(t, PermissionRead, r.Authorize(Identity{Subject: "bob"}, "any/repo"))
+
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n  - subject: bob\n    permission: write\n"), 0644))
+	require.NoError(t, r.Reload())
+	assert.Equal(t, PermissionWrite, r.Authorize(Identity{Subject: "bob"}, "any/repo"))
+}
+
+func TestReloadableAuthorizerReloadKeepsOldACLOnError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n  - subject: bob\n    permission: write\n"), 0644))
+
+	r, err := NewReloadableAuthorizer(path)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n  - subject: bob\n    permission: bogus\n"), 0644))
+	require.Error(t, r.Reload())
+
+	assert.Equal(t, PermissionWrite, r.Authorize(Identity{Subject: "bob"}, "any/repo"))
+}
+
+func TestCertCNAuthenticatorAuthenticate(t *testing.T) {
+	a := &CertCNAuthenticator{GroupsByCN: map[string][]string{"alice": {"admins", "readers"}}}
+
+	cert := selfSignedCertWithCN(t, "alice")
+	id, ok := a.Authenticate(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	require.True(t, ok)
+	assert.Equal(t, "alice", id.Subject)
+	assert.Equal(t, []string{"admins", "readers"}, id.Groups)
+}
+
+func TestCertCNAuthenticatorAuthenticateUnknownCNHasNoGroups(t *testing.T) {
+	a := &CertCNAuthenticator{GroupsByCN: map[string][]string{"alice": {"admins"}}}
+
+	cert := selfSignedCertWithCN(t, "bob")
+	id, ok := a.Authenticate(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	require.True(t, ok)
+	assert.Equal(t, "bob", id.Subject)
+	assert.Empty(t, id.Groups)
+}
+
+func TestCertCNAuthenticatorAuthenticateNoCertificate(t *testing.T) {
+	a := &CertCNAuthenticator{}
+
+	_, ok := a.Authenticate(tls.ConnectionState{})
+	assert.False(t, ok)
+}
+
+func TestLoadGroupsByCN(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "groups")
+	require.NoError(t, os.WriteFile(path, []byte(
+		"# comment\nalice admins,readers\nbob readers\n",
+	), 0644))
+
+	groups, err := loadGroupsByCN(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admins", "readers"}, groups["alice"])
+	assert.Equal(t, []string{"readers"}, groups["bob"])
+}
+
+func TestNewAuthSettingsWiresCertCNAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+
+	caCert := selfSignedCertWithCN(t, "test-ca")
+	caPath := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644))
+
+	groupsPath := filepath.Join(dir, "groups")
+	require.NoError(t, os.WriteFile(groupsPath, []byte("alice admins\n"), 0644))
+
+	s, err := newAuthSettings(authParams{mtlsCAFile: caPath, mtlsGroupsFile: groupsPath})
+	require.NoError(t, err)
+	require.NotNil(t, s.certCNAuthenticator)
+	assert.Equal(t, []string{"admins"}, s.certCNAuthenticator.GroupsByCN["alice"])
+}
+
+func TestNewAuthSettingsCertCNAuthenticatorWithoutGroupsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	caCert := selfSignedCertWithCN(t, "test-ca")
+	caPath := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644))
+
+	s, err := newAuthSettings(authParams{mtlsCAFile: caPath})
+	require.NoError(t, err)
+	require.NotNil(t, s.certCNAuthenticator)
+	assert.Empty(t, s.certCNAuthenticator.GroupsByCN)
+}
+
+func TestReloadableTokenAuthenticatorReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens")
+	require.NoError(t, os.WriteFile(path, []byte("abc123 alice\n"), 0644))
+
+	r, err := NewReloadableTokenAuthenticator(path)
+	require.NoError(t, err)
+
+	_, ok := r.Authenticate("xyz789")
+	assert.False(t, ok)
+
+	require.NoError(t, os.WriteFile(path, []byte("abc123 alice\nxyz789 bob\n"), 0644))
+	require.NoError(t, r.Reload())
+
+	id, ok := r.Authenticate("xyz789")
+	require.True(t, ok)
+	assert.Equal(t, "bob", id.Subject)
+}
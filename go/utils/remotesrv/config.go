@@ -0,0 +1,233 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is prepended to every environment variable that can configure
+// remotesrv, e.g. DOLT_REMOTESRV_GRPC_ADDR.
+const envPrefix = "DOLT_REMOTESRV_"
+
+// config holds the resolved value of every setting that can be supplied to
+// remotesrv via flag, environment variable, or config file. Each of those
+// layers is read into a configOverlay, whose nil fields mean "not set" at
+// that layer, so layers can be merged in precedence order without a
+// zero-value ever masking a lower-precedence value.
+type config struct {
+	ReadOnly bool   `yaml:"read_only" toml:"read_only"`
+	RepoMode bool   `yaml:"repo_mode" toml:"repo_mode"`
+	Dir      string `yaml:"dir" toml:"dir"`
+	GrpcAddr string `yaml:"grpc_addr" toml:"grpc_addr"`
+	HttpAddr string `yaml:"http_addr" toml:"http_addr"`
+	HttpHost string `yaml:"http_host" toml:"http_host"`
+}
+
+// configOverlay is the same shape as config, but every field is a pointer
+// so that "unset" can be distinguished from "set to the zero value". Each
+// configuration source (flags, env, file) produces an overlay, and the
+// overlays are applied over the defaults in precedence order.
+type configOverlay struct {
+	ReadOnly *bool
+	RepoMode *bool
+	Dir      *string
+	GrpcAddr *string
+	HttpAddr *string
+	HttpHost *string
+}
+
+// apply overwrites the fields of c for which o has a value set, returning
+// the result. Lower precedence overlays should be applied first.
+func (c config) apply(o configOverlay) config {
+	if o.ReadOnly != nil {
+		c.ReadOnly = *o.ReadOnly
+	}
+	if o.RepoMode != nil {
+		c.RepoMode = *o.RepoMode
+	}
+	if o.Dir != nil {
+		c.Dir = *o.Dir
+	}
+	if o.GrpcAddr != nil {
+		c.GrpcAddr = *o.GrpcAddr
+	}
+	if o.HttpAddr != nil {
+		c.HttpAddr = *o.HttpAddr
+	}
+	if o.HttpHost != nil {
+		c.HttpHost = *o.HttpHost
+	}
+	return c
+}
+
+// fileConfig mirrors config, but every field is a pointer so the YAML/TOML
+// decoder leaves a key the file doesn't mention as nil, rather than
+// silently filling it with the Go zero value. Without this, a file that
+// sets only one field would decode the rest as "" / false and overlayFromFile
+// would mistake that for the operator explicitly unsetting them.
+type fileConfig struct {
+	ReadOnly *bool   `yaml:"read_only" toml:"read_only"`
+	RepoMode *bool   `yaml:"repo_mode" toml:"repo_mode"`
+	Dir      *string `yaml:"dir" toml:"dir"`
+	GrpcAddr *string `yaml:"grpc_addr" toml:"grpc_addr"`
+	HttpAddr *string `yaml:"http_addr" toml:"http_addr"`
+	HttpHost *string `yaml:"http_host" toml:"http_host"`
+}
+
+// overlayFromFile parses a YAML or TOML config file, selecting the format
+// based on the file extension (.yaml/.yml or .toml). Only the fields the
+// file actually declares are set in the returned overlay; everything else
+// is left nil so lower-precedence overlays and defaults pass through.
+func overlayFromFile(path string) (configOverlay, error) {
+	var o configOverlay
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return o, errors.Wrap(err, "read config file")
+	}
+
+	var fc fileConfig
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &fc); err != nil {
+			return o, errors.Wrap(err, "parse yaml config file")
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &fc); err != nil {
+			return o, errors.Wrap(err, "parse toml config file")
+		}
+	default:
+		return o, errors.Errorf("unrecognized config file extension %q; expected .yaml, .yml, or .toml", ext)
+	}
+
+	o.ReadOnly = fc.ReadOnly
+	o.RepoMode = fc.RepoMode
+	o.Dir = fc.Dir
+	o.GrpcAddr = fc.GrpcAddr
+	o.HttpAddr = fc.HttpAddr
+	o.HttpHost = fc.HttpHost
+
+	return o, nil
+}
+
+// overlayFromEnv reads DOLT_REMOTESRV_* environment variables, producing
+// an overlay with only the fields whose variable is actually set.
+func overlayFromEnv() (configOverlay, error) {
+	var o configOverlay
+
+	if v, ok := os.LookupEnv(envPrefix + "READ_ONLY"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, errors.Wrapf(err, "parse %sREAD_ONLY", envPrefix)
+		}
+		o.ReadOnly = &b
+	}
+	if v, ok := os.LookupEnv(envPrefix + "REPO_MODE"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, errors.Wrapf(err, "parse %sREPO_MODE", envPrefix)
+		}
+		o.RepoMode = &b
+	}
+	if v, ok := os.LookupEnv(envPrefix + "DIR"); ok {
+		o.Dir = &v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "GRPC_ADDR"); ok {
+		o.GrpcAddr = &v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "HTTP_ADDR"); ok {
+		o.HttpAddr = &v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "HTTP_HOST"); ok {
+		o.HttpHost = &v
+	}
+
+	return o, nil
+}
+
+// flagValues bundles the pointers flag.Bool/flag.String hand back, so that
+// overlayFromFlags can tell which ones the user actually passed.
+type flagValues struct {
+	readOnly *bool
+	repoMode *bool
+	dir      *string
+	grpcAddr *string
+	httpAddr *string
+	httpHost *string
+}
+
+// overlayFromFlags builds an overlay containing only the flags named in
+// set, which callers populate via flag.Visit so that flags left at their
+// defaults are omitted and env vars or config files can still take effect
+// for them.
+func overlayFromFlags(fv flagValues, set map[string]bool) configOverlay {
+	var o configOverlay
+
+	if set["read-only"] {
+		o.ReadOnly = fv.readOnly
+	}
+	if set["repo-mode"] {
+		o.RepoMode = fv.repoMode
+	}
+	if set["dir"] {
+		o.Dir = fv.dir
+	}
+	if set["grpc-addr"] {
+		o.GrpcAddr = fv.grpcAddr
+	}
+	if set["http-addr"] {
+		o.HttpAddr = fv.httpAddr
+	}
+	if set["http-host"] {
+		o.HttpHost = fv.httpHost
+	}
+
+	return o
+}
+
+// loadConfig resolves the final configuration from defaults, an optional
+// config file, environment variables, and command line flags, applied in
+// that order so that flags always win and defaults always lose. setFlags
+// is the set of flag names the user actually passed, as collected by
+// flag.Visit after flag.Parse.
+func loadConfig(defaults config, configPath string, fv flagValues, setFlags map[string]bool) (config, error) {
+	c := defaults
+
+	if configPath != "" {
+		fileOverlay, err := overlayFromFile(configPath)
+		if err != nil {
+			return config{}, errors.Wrap(err, "load config file")
+		}
+		c = c.apply(fileOverlay)
+	}
+
+	envOverlay, err := overlayFromEnv()
+	if err != nil {
+		return config{}, errors.Wrap(err, "load config from environment")
+	}
+	c = c.apply(envOverlay)
+
+	c = c.apply(overlayFromFlags(fv, setFlags))
+
+	return c, nil
+}
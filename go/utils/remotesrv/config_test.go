@@ -0,0 +1,102 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayFromFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remotesrv.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("grpc_addr: 0.0.0.0:9090\nread_only: true\n"), 0644))
+
+	o, err := overlayFromFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:9090", *o.GrpcAddr)
+	assert.True(t, *o.ReadOnly)
+}
+
+func TestOverlayFromFilePartial(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remotesrv.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("grpc_addr: 0.0.0.0:9090\n"), 0644))
+
+	o, err := overlayFromFile(path)
+	require.NoError(t, err)
+	require.NotNil(t, o.GrpcAddr)
+	assert.Equal(t, "0.0.0.0:9090", *o.GrpcAddr)
+
+	assert.Nil(t, o.HttpAddr, "fields the file doesn't mention should be left unset, not zeroed")
+	assert.Nil(t, o.Dir)
+	assert.Nil(t, o.HttpHost)
+	assert.Nil(t, o.RepoMode)
+	assert.Nil(t, o.ReadOnly)
+}
+
+func TestLoadConfigPartialFilePreservesDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remotesrv.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("grpc_addr: 0.0.0.0:9090\n"), 0644))
+
+	cfg, err := loadConfig(config{GrpcAddr: "localhost:50051", HttpAddr: "localhost:80"}, path, flagValues{}, map[string]bool{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "0.0.0.0:9090", cfg.GrpcAddr)
+	assert.Equal(t, "localhost:80", cfg.HttpAddr, "a partial config file must not clobber fields it doesn't mention")
+}
+
+func TestOverlayFromFileUnsupportedExtension(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remotesrv.json")
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+
+	_, err := overlayFromFile(path)
+	require.Error(t, err)
+}
+
+func TestOverlayFromEnv(t *testing.T) {
+	t.Setenv(envPrefix+"GRPC_ADDR", "localhost:12345")
+	t.Setenv(envPrefix+"READ_ONLY", "true")
+
+	o, err := overlayFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:12345", *o.GrpcAddr)
+	assert.True(t, *o.ReadOnly)
+	assert.Nil(t, o.HttpAddr)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remotesrv.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("grpc_addr: from-file:1\nhttp_addr: from-file:2\n"), 0644))
+
+	t.Setenv(envPrefix+"GRPC_ADDR", "from-env:1")
+
+	grpcAddr := "from-flag:1"
+	cfg, err := loadConfig(config{GrpcAddr: "default:1", HttpAddr: "default:2"}, path, flagValues{
+		grpcAddr: &grpcAddr,
+	}, map[string]bool{"grpc-addr": true})
+	require.NoError(t, err)
+
+	// flag beats env beats file beats default, per field.
+	assert.Equal(t, "from-flag:1", cfg.GrpcAddr)
+	assert.Equal(t, "from-file:2", cfg.HttpAddr)
+}
@@ -0,0 +1,389 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/doltdb"
+	"github.com/dolthub/dolt/go/libraries/doltcore/env"
+	"github.com/dolthub/dolt/go/libraries/doltcore/remotesrv"
+	"github.com/dolthub/dolt/go/libraries/utils/filesys"
+	"github.com/dolthub/dolt/go/store/chunks"
+	"github.com/dolthub/dolt/go/store/datas"
+	"github.com/dolthub/dolt/go/store/hash"
+)
+
+// MultiTenantDBCacheOpts configures a MultiTenantDBCache.
+type MultiTenantDBCacheOpts struct {
+	// MaxOpenRepos is the maximum number of repositories kept loaded at
+	// once. When exceeded, the least recently used repository is evicted.
+	// Zero means unlimited.
+	MaxOpenRepos int
+
+	// IdleTimeout evicts a repository that hasn't been accessed in this
+	// long. Zero disables idle eviction.
+	IdleTimeout time.Duration
+
+	// ReadOnlyOverrides maps a repo path (relative to BaseDir, using
+	// forward slashes, e.g. "someorg/somerepo") to a read-only override
+	// for that repo specifically, regardless of the server-wide default.
+	ReadOnlyOverrides map[string]bool
+}
+
+// repoEntry is a single cached, lazily-loaded repository. Its store is
+// wrapped in a refCountedStore so that eviction (on idle-timeout or
+// MaxOpenRepos) doesn't close the underlying store out from under a
+// request that's still using it; the close is deferred until the last
+// in-flight call against it returns.
+type repoEntry struct {
+	path     string
+	store    remotesrv.RemoteSrvStore
+	lastUsed time.Time
+	elem     *list.Element
+
+	mu      sync.Mutex
+	refs    int
+	evicted bool
+	closed  bool
+}
+
+// acquire marks the start of a call against e.store, delaying any eviction
+// close until the matching release.
+func (e *repoEntry) acquire() {
+	e.mu.Lock()
+	e.refs++
+	e.mu.Unlock()
+}
+
+// release marks the end of a call against e.store, closing it now if it was
+// evicted while the call was in flight and this was the last one.
+func (e *repoEntry) release() {
+	e.mu.Lock()
+	e.refs--
+	closeNow := e.evicted && e.refs == 0 && !e.closed
+	if closeNow {
+		e.closed = true
+	}
+	e.mu.Unlock()
+
+	if closeNow {
+		closeStore(e.store)
+	}
+}
+
+// evict marks e as evicted from the cache, closing its store immediately
+// if nothing is using it, or leaving that to the last matching release
+// otherwise.
+func (e *repoEntry) evict() {
+	e.mu.Lock()
+	e.evicted = true
+	closeNow := e.refs == 0 && !e.closed
+	if closeNow {
+		e.closed = true
+	}
+	e.mu.Unlock()
+
+	if closeNow {
+		closeStore(e.store)
+	}
+}
+
+// refCountedStore wraps a repoEntry's underlying RemoteSrvStore so each
+// Get/Has/Put call is bracketed by acquire/release, letting the cache
+// evict the entry mid-use without closing its store until the call
+// actually finishes.
+type refCountedStore struct {
+	remotesrv.RemoteSrvStore
+	entry *repoEntry
+}
+
+func (s *refCountedStore) Get(ctx context.Context, h hash.Hash) (chunks.Chunk, error) {
+	s.entry.acquire()
+	defer s.entry.release()
+	return s.RemoteSrvStore.Get(ctx, h)
+}
+
+func (s *refCountedStore) Has(ctx context.Context, h hash.Hash) (bool, error) {
+	s.entry.acquire()
+	defer s.entry.release()
+	return s.RemoteSrvStore.Has(ctx, h)
+}
+
+func (s *refCountedStore) Put(ctx context.Context, c chunks.Chunk, getAddrs chunks.GetAddrsCb) error {
+	s.entry.acquire()
+	defer s.entry.release()
+	return s.RemoteSrvStore.Put(ctx, c, getAddrs)
+}
+
+// Close lets closeStore's io.Closer check see through the wrapper to the
+// underlying store, since RemoteSrvStore itself doesn't declare Close and
+// so embedding it alone wouldn't promote one.
+func (s *refCountedStore) Close() error {
+	if c, ok := s.RemoteSrvStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// MultiTenantDBCache implements remotesrv.DBCache by mapping request paths
+// of the form "<org>/<repo>" to independent dolt repositories rooted under
+// BaseDir, e.g. BaseDir/<org>/<repo>. Repositories are loaded lazily on
+// first access and evicted on an LRU basis once MaxOpenRepos or IdleTimeout
+// is exceeded, so a newly created repo directory under BaseDir is picked
+// up the first time it's requested without restarting the server.
+type MultiTenantDBCache struct {
+	fs      filesys.Filesys
+	baseDir string
+	opts    MultiTenantDBCacheOpts
+
+	mu      sync.Mutex
+	entries map[string]*repoEntry
+	lru     *list.List // front = most recently used
+
+	// loadRepoFunc loads the store for a not-yet-cached repo path. It
+	// defaults to loading a local dolt repo under baseDir, but callers
+	// like the object-storage backend substitute their own loader.
+	loadRepoFunc func(ctx context.Context, key string) (remotesrv.RemoteSrvStore, error)
+}
+
+var _ remotesrv.DBCache = (*MultiTenantDBCache)(nil)
+
+// NewMultiTenantDBCache returns a MultiTenantDBCache rooted at baseDir.
+func NewMultiTenantDBCache(fs filesys.Filesys, baseDir string, opts MultiTenantDBCacheOpts) *MultiTenantDBCache {
+	c := &MultiTenantDBCache{
+		fs:      fs,
+		baseDir: baseDir,
+		opts:    opts,
+		entries: make(map[string]*repoEntry),
+		lru:     list.New(),
+	}
+	c.loadRepoFunc = c.loadRepo
+	return c
+}
+
+// Get loads, or returns the already-loaded, RemoteSrvStore for the
+// repository at repoPath (e.g. "someorg/somerepo"), relative to baseDir.
+func (c *MultiTenantDBCache) Get(ctx context.Context, repoPath string) (remotesrv.RemoteSrvStore, error) {
+	key, err := normalizeRepoPath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.touch(e)
+		c.mu.Unlock()
+		return e.store, nil
+	}
+	c.mu.Unlock()
+
+	store, err := c.loadRepoFunc(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another goroutine may have loaded the same repo while we didn't
+	// hold the lock; prefer whichever entry is already cached, and
+	// discard the store we just loaded instead of leaking it.
+	if e, ok := c.entries[key]; ok {
+		c.touch(e)
+		closeStore(store)
+		return e.store, nil
+	}
+
+	e := &repoEntry{path: key, lastUsed: now()}
+	e.store = &refCountedStore{RemoteSrvStore: store, entry: e}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+
+	c.evictLocked()
+
+	return e.store, nil
+}
+
+// IsReadOnly reports whether writes to repoPath should be rejected,
+// consulting the per-repo override before falling back to defaultReadOnly.
+func (c *MultiTenantDBCache) IsReadOnly(repoPath string, defaultReadOnly bool) bool {
+	key, err := normalizeRepoPath(repoPath)
+	if err != nil {
+		// An unrepresentable repo path can't match any override and isn't
+		// a repo this server will ever load; fail closed rather than
+		// falling through to defaultReadOnly.
+		return true
+	}
+	if ro, ok := c.opts.ReadOnlyOverrides[key]; ok {
+		return ro
+	}
+	return defaultReadOnly
+}
+
+func (c *MultiTenantDBCache) loadRepo(ctx context.Context, key string) (remotesrv.RemoteSrvStore, error) {
+	repoDir := filepath.Join(c.baseDir, filepath.FromSlash(key))
+
+	exists, isDir := c.fs.Exists(repoDir)
+	if !exists || !isDir {
+		return nil, errors.Errorf("no repository at %q", key)
+	}
+
+	repoFs, err := c.fs.WithWorkingDir(repoDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "set working dir for repo %q", key)
+	}
+
+	dEnv := env.Load(ctx, env.GetCurrentUserHomeDir, repoFs, doltdb.LocalDirDoltDB, "remotesrv")
+	if !dEnv.Valid() {
+		return nil, errors.Errorf("failed to load repository %q", key)
+	}
+
+	db := doltdb.HackDatasDatabaseFromDoltDB(dEnv.DoltDB)
+	cs := datas.ChunkStoreFromDatabase(db)
+
+	store, ok := cs.(remotesrv.RemoteSrvStore)
+	if !ok {
+		return nil, errors.Errorf("chunk store for repo %q does not support remotesrv", key)
+	}
+
+	return instrumentStore(key, store), nil
+}
+
+// touch marks e as most recently used. Callers must hold c.mu.
+func (c *MultiTenantDBCache) touch(e *repoEntry) {
+	e.lastUsed = now()
+	c.lru.MoveToFront(e.elem)
+}
+
+// evictLocked drops entries beyond MaxOpenRepos and any entry idle longer
+// than IdleTimeout. Callers must hold c.mu.
+func (c *MultiTenantDBCache) evictLocked() {
+	if c.opts.IdleTimeout > 0 {
+		cutoff := now().Add(-c.opts.IdleTimeout)
+		for elem := c.lru.Back(); elem != nil; {
+			e := elem.Value.(*repoEntry)
+			prev := elem.Prev()
+			if e.lastUsed.Before(cutoff) {
+				c.removeLocked(e)
+			}
+			elem = prev
+		}
+	}
+
+	if c.opts.MaxOpenRepos > 0 {
+		for len(c.entries) > c.opts.MaxOpenRepos {
+			back := c.lru.Back()
+			if back == nil {
+				break
+			}
+			c.removeLocked(back.Value.(*repoEntry))
+		}
+	}
+}
+
+// removeLocked drops e from the cache and evicts its store. Callers must
+// hold c.mu.
+func (c *MultiTenantDBCache) removeLocked(e *repoEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.path)
+	e.evict()
+}
+
+// normalizeRepoPath cleans a client-supplied repo path (e.g. "/org/repo/")
+// to the canonical "org/repo" form used both as a cache key and, by
+// loadRepo and newObjectStoreChunkStore, as a filesystem/object-key path
+// component. Since repoPath is client-controlled, a ".." segment (e.g.
+// "../../etc") must be rejected here rather than passed through: both
+// callers join the result directly onto a local directory, so anything
+// other than a same-tree relative path would let a request escape it.
+func normalizeRepoPath(p string) (string, error) {
+	clean := strings.Trim(filepath.ToSlash(p), "/")
+	for _, seg := range strings.Split(clean, "/") {
+		if seg == ".." || seg == "." {
+			return "", errors.Errorf("invalid repo path %q", p)
+		}
+	}
+	return clean, nil
+}
+
+// closeStore releases s if it supports being closed, logging rather than
+// returning any error since callers use this once a store is no longer
+// reachable (a redundant load that lost a race, or an evicted entry with
+// no in-flight calls left), not while it's still in use.
+func closeStore(s remotesrv.RemoteSrvStore) {
+	if c, ok := s.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Println("error closing discarded repo store:", err.Error())
+		}
+	}
+}
+
+// loadReadOnlyOverrides reads a file of "<repo-path> <true|false>" lines
+// (one per line, '#' comments allowed) suitable for
+// MultiTenantDBCacheOpts.ReadOnlyOverrides.
+func loadReadOnlyOverrides(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open read-only overrides file")
+	}
+	defer f.Close()
+
+	overrides := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("malformed read-only overrides line: %q", line)
+		}
+
+		ro, err := strconv.ParseBool(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse read-only overrides line: %q", line)
+		}
+
+		key, err := normalizeRepoPath(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed read-only overrides line: %q", line)
+		}
+		overrides[key] = ro
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read read-only overrides file")
+	}
+
+	return overrides, nil
+}
+
+// now is a var so tests can fake the clock without sleeping.
+var now = time.Now
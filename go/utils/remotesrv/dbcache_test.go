@@ -0,0 +1,274 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/remotesrv"
+	"github.com/dolthub/dolt/go/store/chunks"
+	"github.com/dolthub/dolt/go/store/hash"
+)
+
+// fakeStore is a minimal remotesrv.RemoteSrvStore used to exercise
+// MultiTenantDBCache's loading and eviction paths without a real repo.
+type fakeStore struct {
+	remotesrv.RemoteSrvStore
+	closed int32
+}
+
+func (s *fakeStore) Close() error {
+	atomic.AddInt32(&s.closed, 1)
+	return nil
+}
+
+func TestNormalizeRepoPath(t *testing.T) {
+	key, err := normalizeRepoPath("/org/repo/")
+	require.NoError(t, err)
+	assert.Equal(t, "org/repo", key)
+
+	key, err = normalizeRepoPath("org/repo")
+	require.NoError(t, err)
+	assert.Equal(t, "org/repo", key)
+}
+
+// TestNormalizeRepoPathRejectsTraversal guards against a client-supplied
+// repo path escaping baseDir: both loadRepo and newObjectStoreChunkStore
+// join this key directly onto a local directory, so a ".." segment must
+// never survive normalization.
+func TestNormalizeRepoPathRejectsTraversal(t *testing.T) {
+	_, err := normalizeRepoPath("../../etc")
+	assert.Error(t, err)
+
+	_, err = normalizeRepoPath("org/../../../etc/passwd")
+	assert.Error(t, err)
+
+	_, err = normalizeRepoPath("org/./repo")
+	assert.Error(t, err)
+}
+
+func TestMultiTenantDBCacheIsReadOnly(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{
+		ReadOnlyOverrides: map[string]bool{
+			"org/frozen": true,
+		},
+	})
+
+	assert.True(t, c.IsReadOnly("/org/frozen/", false))
+	assert.False(t, c.IsReadOnly("org/other", false))
+	assert.True(t, c.IsReadOnly("org/other", true))
+}
+
+func TestMultiTenantDBCacheEvictsLRU(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{MaxOpenRepos: 2})
+
+	c.entries["a"] = &repoEntry{path: "a", lastUsed: now()}
+	c.entries["a"].elem = c.lru.PushFront(c.entries["a"])
+	c.entries["b"] = &repoEntry{path: "b", lastUsed: now()}
+	c.entries["b"].elem = c.lru.PushFront(c.entries["b"])
+	c.entries["c"] = &repoEntry{path: "c", lastUsed: now()}
+	c.entries["c"].elem = c.lru.PushFront(c.entries["c"])
+
+	c.evictLocked()
+
+	assert.Len(t, c.entries, 2)
+	_, ok := c.entries["a"]
+	assert.False(t, ok, "least recently used entry should have been evicted")
+}
+
+func TestMultiTenantDBCacheEvictsIdle(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{IdleTimeout: time.Minute})
+
+	c.entries["stale"] = &repoEntry{path: "stale", lastUsed: now().Add(-time.Hour)}
+	c.entries["stale"].elem = c.lru.PushFront(c.entries["stale"])
+	c.entries["fresh"] = &repoEntry{path: "fresh", lastUsed: now()}
+	c.entries["fresh"].elem = c.lru.PushFront(c.entries["fresh"])
+
+	c.evictLocked()
+
+	_, ok := c.entries["stale"]
+	assert.False(t, ok)
+	_, ok = c.entries["fresh"]
+	assert.True(t, ok)
+}
+
+// TestMultiTenantDBCacheEvictionClosesStore guards against the store for an
+// idle-evicted repo being leaked: once MultiTenantDBCache has finished
+// evicting it, its underlying store must be closed.
+func TestMultiTenantDBCacheEvictionClosesStore(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{IdleTimeout: time.Minute})
+
+	store := &fakeStore{}
+	c.loadRepoFunc = func(ctx context.Context, key string) (remotesrv.RemoteSrvStore, error) {
+		return store, nil
+	}
+
+	_, err := c.Get(context.Background(), "org/stale")
+	require.NoError(t, err)
+
+	c.mu.Lock()
+	c.entries["org/stale"].lastUsed = now().Add(-time.Hour)
+	c.evictLocked()
+	c.mu.Unlock()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.closed))
+}
+
+// TestMultiTenantDBCacheEvictionDefersCloseUntilInFlightCallFinishes proves
+// evicting a repo while a request is still using its store doesn't close
+// the store out from under that request: the close must wait for the
+// in-flight call to return.
+func TestMultiTenantDBCacheEvictionDefersCloseUntilInFlightCallFinishes(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{IdleTimeout: time.Minute})
+
+	inGet := make(chan struct{})
+	releaseGet := make(chan struct{})
+	store := &blockingFakeStore{fakeStore: fakeStore{}, inGet: inGet, release: releaseGet}
+	c.loadRepoFunc = func(ctx context.Context, key string) (remotesrv.RemoteSrvStore, error) {
+		return store, nil
+	}
+
+	got, err := c.Get(context.Background(), "org/busy")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = got.Get(context.Background(), hash.Hash{})
+		close(done)
+	}()
+
+	<-inGet
+
+	c.mu.Lock()
+	c.entries["org/busy"].lastUsed = now().Add(-time.Hour)
+	c.evictLocked()
+	c.mu.Unlock()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&store.closed), "store must not be closed while a call against it is in flight")
+
+	close(releaseGet)
+	<-done
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.closed), "store should be closed once the in-flight call finishes")
+}
+
+// blockingFakeStore's Get blocks until release is closed, signaling inGet
+// first so a test can evict the entry while the call is in flight.
+type blockingFakeStore struct {
+	fakeStore
+	inGet   chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingFakeStore) Get(ctx context.Context, h hash.Hash) (chunks.Chunk, error) {
+	close(s.inGet)
+	<-s.release
+	return chunks.NewChunk(nil), nil
+}
+
+// TestMultiTenantDBCacheConcurrentDistinctRepos exercises concurrent Get
+// calls for distinct repositories, verifying every caller of a repo shares
+// one store, each repo gets its own independent store, and any redundant
+// load by callers racing on the same repo is discarded.
+func TestMultiTenantDBCacheConcurrentDistinctRepos(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{})
+
+	var loadedMu sync.Mutex
+	loadedByRepo := make(map[string][]*fakeStore)
+	c.loadRepoFunc = func(ctx context.Context, key string) (remotesrv.RemoteSrvStore, error) {
+		s := &fakeStore{}
+		loadedMu.Lock()
+		loadedByRepo[key] = append(loadedByRepo[key], s)
+		loadedMu.Unlock()
+		return s, nil
+	}
+
+	const repoCount = 8
+	const callersPerRepo = 4
+
+	var wg sync.WaitGroup
+	stores := make([][]remotesrv.RemoteSrvStore, repoCount)
+	for i := 0; i < repoCount; i++ {
+		stores[i] = make([]remotesrv.RemoteSrvStore, callersPerRepo)
+	}
+
+	for i := 0; i < repoCount; i++ {
+		repoPath := fmt.Sprintf("org/repo-%d", i)
+		for j := 0; j < callersPerRepo; j++ {
+			wg.Add(1)
+			go func(i, j int, repoPath string) {
+				defer wg.Done()
+				store, err := c.Get(context.Background(), repoPath)
+				assert.NoError(t, err)
+				stores[i][j] = store
+			}(i, j, repoPath)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < repoCount; i++ {
+		repoPath := fmt.Sprintf("org/repo-%d", i)
+		loaded := loadedByRepo[repoPath]
+		if assert.NotEmpty(t, loaded) {
+			var closed int32
+			for _, s := range loaded {
+				closed += atomic.LoadInt32(&s.closed)
+			}
+			assert.Equal(t, int32(len(loaded)-1), closed, "every load of %s except the cached one should have been discarded", repoPath)
+		}
+		for j := 1; j < callersPerRepo; j++ {
+			assert.Same(t, stores[i][0], stores[i][j], "all callers for %s should share one store", repoPath)
+		}
+		for k := i + 1; k < repoCount; k++ {
+			assert.NotSame(t, stores[i][0], stores[k][0], "distinct repos should get distinct stores")
+		}
+	}
+}
+
+// TestMultiTenantDBCacheGetRaceDiscardsLoser exercises the double-checked
+// locking path in Get directly: when two loads for the same key race, the
+// loser's store is discarded (closed) rather than returned or leaked.
+func TestMultiTenantDBCacheGetRaceDiscardsLoser(t *testing.T) {
+	c := NewMultiTenantDBCache(nil, "/repos", MultiTenantDBCacheOpts{})
+
+	winner := &fakeStore{}
+	loser := &fakeStore{}
+
+	// Simulate loadRepoFunc racing with another goroutine that populates
+	// the entry first: by the time loadRepoFunc returns, the entry is
+	// already cached, so Get must discard what it just loaded.
+	c.loadRepoFunc = func(ctx context.Context, key string) (remotesrv.RemoteSrvStore, error) {
+		c.mu.Lock()
+		e := &repoEntry{path: key, store: winner, lastUsed: now()}
+		e.elem = c.lru.PushFront(e)
+		c.entries[key] = e
+		c.mu.Unlock()
+		return loser, nil
+	}
+
+	store, err := c.Get(context.Background(), "org/racey")
+	assert.NoError(t, err)
+	assert.Same(t, winner, store)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loser.closed), "losing store should have been closed")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&winner.closed), "winning store should not have been closed")
+}
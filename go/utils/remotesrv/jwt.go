@@ -0,0 +1,205 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JWKSAuthenticator verifies RS256-signed JWTs against the keys published
+// at a JWKS URL, caching the key set for jwksCacheTTL between refreshes.
+type JWKSAuthenticator struct {
+	jwksURL string
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// jwksCacheTTL bounds how often a JWKSAuthenticator refetches its key set.
+const jwksCacheTTL = 5 * time.Minute
+
+// jwkSet is the subset of RFC 7517 this package understands: RSA keys
+// suitable for RS256 verification.
+type jwkSet struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// jwksFetchTimeout bounds how long a JWKSAuthenticator will wait for the
+// JWKS endpoint to respond before giving up on a key refresh.
+const jwksFetchTimeout = 10 * time.Second
+
+// NewJWKSAuthenticator returns an authenticator that fetches its key set
+// from jwksURL on demand.
+func NewJWKSAuthenticator(jwksURL string) *JWKSAuthenticator {
+	return &JWKSAuthenticator{
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+// Authenticate verifies tokenString's signature and expiry, returning the
+// Identity built from its "sub" and "groups" claims.
+func (a *JWKSAuthenticator) Authenticate(tokenString string) (Identity, bool, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return Identity{}, false, errors.New("malformed jwt: expected header.payload.signature")
+	}
+
+	header, err := decodeJWTSegment(parts[0])
+	if err != nil {
+		return Identity{}, false, errors.Wrap(err, "decode jwt header")
+	}
+	var headerClaims struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &headerClaims); err != nil {
+		return Identity{}, false, errors.Wrap(err, "parse jwt header")
+	}
+	if headerClaims.Alg != "RS256" {
+		return Identity{}, false, errors.Errorf("unsupported jwt alg %q; only RS256 is supported", headerClaims.Alg)
+	}
+
+	key, err := a.key(headerClaims.Kid)
+	if err != nil {
+		return Identity{}, false, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, false, errors.Wrap(err, "decode jwt signature")
+	}
+
+	signedInput := parts[0] + "." + parts[1]
+	hashed := sha256.Sum256([]byte(signedInput))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return Identity{}, false, errors.Wrap(err, "verify jwt signature")
+	}
+
+	payload, err := decodeJWTSegment(parts[1])
+	if err != nil {
+		return Identity{}, false, errors.Wrap(err, "decode jwt payload")
+	}
+	var claims struct {
+		Subject string   `json:"sub"`
+		Groups  []string `json:"groups"`
+		Exp     int64    `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Identity{}, false, errors.Wrap(err, "parse jwt claims")
+	}
+	if claims.Exp != 0 && time.Now().Unix() >= claims.Exp {
+		return Identity{}, false, errors.New("jwt has expired")
+	}
+
+	return Identity{Subject: claims.Subject, Groups: claims.Groups}, true, nil
+}
+
+func (a *JWKSAuthenticator) key(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	stale := a.keys == nil || time.Since(a.fetchedAt) > jwksCacheTTL
+	a.mu.Unlock()
+
+	// fetchKeys makes a synchronous HTTP request; do it without holding
+	// a.mu so a slow or stuck JWKS endpoint doesn't block every other
+	// concurrent Authenticate call, just this one's refresh.
+	if stale {
+		keys, err := a.fetchKeys()
+		if err != nil {
+			return nil, errors.Wrap(err, "fetch jwks")
+		}
+
+		a.mu.Lock()
+		a.keys = keys
+		a.fetchedAt = time.Now()
+		a.mu.Unlock()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, ok := a.keys[kid]
+	if !ok {
+		return nil, errors.Errorf("no jwks key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+func (a *JWKSAuthenticator) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := a.client.Get(a.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %d fetching jwks", resp.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "decode jwks body")
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode modulus for kid %q", k.Kid)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode exponent for kid %q", k.Kid)
+		}
+
+		e := 0
+		for _, b := range eBytes {
+			e = e<<8 | int(b)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: e,
+		}
+	}
+
+	return keys, nil
+}
+
+func decodeJWTSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
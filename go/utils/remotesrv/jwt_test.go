@@ -0,0 +1,237 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwksTestServer serves a JWKS document for a single RSA key under kid,
+// counting how many times it's been fetched so tests can assert on cache
+// behavior.
+type jwksTestServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+}
+
+func newJWKSTestServer(t *testing.T, kid string, pub *rsa.PublicKey) *jwksTestServer {
+	t.Helper()
+
+	s := &jwksTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+
+		doc := struct {
+			Keys []struct {
+				Kid string `json:"kid"`
+				Kty string `json:"kty"`
+				N   string `json:"n"`
+				E   string `json:"e"`
+			} `json:"keys"`
+		}{}
+		doc.Keys = append(doc.Keys, struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		}{
+			Kid: kid,
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(bigEndianBytes(pub.E)),
+		})
+
+		require.NoError(t, json.NewEncoder(w).Encode(doc))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// bigEndianBytes encodes a small positive int (an RSA public exponent) as
+// the minimal big-endian byte string a JWKS "e" field expects.
+func bigEndianBytes(n int) []byte {
+	if n == 0 {
+		return []byte{0}
+	}
+	var b []byte
+	for n > 0 {
+		b = append([]byte{byte(n & 0xff)}, b...)
+		n >>= 8
+	}
+	return b
+}
+
+// signJWT builds a compact JWT of header.payload.signature, signed with
+// RS256 under priv, using alg in the header (letting tests build malformed
+// tokens) and claims as the payload.
+func signJWT(t *testing.T, priv *rsa.PrivateKey, kid, alg string, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signedInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hashed := sha256.Sum256([]byte(signedInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hashed[:])
+	require.NoError(t, err)
+
+	return signedInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWKSAuthenticatorAuthenticateValidToken(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-1", "RS256", map[string]interface{}{"sub": "alice", "groups": []string{"readers"}})
+
+	id, ok, err := a.Authenticate(token)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "alice", id.Subject)
+	assert.Equal(t, []string{"readers"}, id.Groups)
+}
+
+func TestJWKSAuthenticatorAuthenticateBadSignature(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-1", "RS256", map[string]interface{}{"sub": "alice"})
+	// Corrupt the signature via its first character, which carries six
+	// full bits; the last one carries only two, and the decoder ignores the
+	// rest, so changing it can leave the signature unchanged.
+	sigStart := strings.LastIndex(token, ".") + 1
+	corrupted := "A"
+	if token[sigStart] == 'A' {
+		corrupted = "B"
+	}
+	token = token[:sigStart] + corrupted + token[sigStart+1:]
+
+	_, ok, err := a.Authenticate(token)
+	assert.False(t, ok)
+	assert.Error(t, err)
+}
+
+func TestJWKSAuthenticatorAuthenticateExpiredToken(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-1", "RS256", map[string]interface{}{
+		"sub": "alice",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	_, ok, err := a.Authenticate(token)
+	assert.False(t, ok)
+	assert.Error(t, err)
+}
+
+func TestJWKSAuthenticatorAuthenticateUnsupportedAlg(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-1", "HS256", map[string]interface{}{"sub": "alice"})
+
+	_, ok, err := a.Authenticate(token)
+	assert.False(t, ok)
+	assert.Error(t, err)
+}
+
+func TestJWKSAuthenticatorAuthenticateUnknownKid(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-2", "RS256", map[string]interface{}{"sub": "alice"})
+
+	_, ok, err := a.Authenticate(token)
+	assert.False(t, ok)
+	assert.Error(t, err)
+}
+
+func TestJWKSAuthenticatorKeyCachedWithinTTL(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-1", "RS256", map[string]interface{}{"sub": "alice"})
+
+	_, ok, err := a.Authenticate(token)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, ok, err = a.Authenticate(token)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Equal(t, int32(1), srv.fetches.Load(), "a second call within the TTL should reuse the cached key set")
+}
+
+func TestJWKSAuthenticatorKeyRefetchesAfterTTL(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := newJWKSTestServer(t, "key-1", &priv.PublicKey)
+	a := NewJWKSAuthenticator(srv.URL)
+
+	token := signJWT(t, priv, "key-1", "RS256", map[string]interface{}{"sub": "alice"})
+
+	_, ok, err := a.Authenticate(token)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int32(1), srv.fetches.Load())
+
+	// Simulate the TTL having elapsed without waiting for it.
+	a.fetchedAt = time.Now().Add(-jwksCacheTTL - time.Second)
+
+	_, ok, err = a.Authenticate(token)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int32(2), srv.fetches.Load(), "a call after the TTL has elapsed should refetch the key set")
+}
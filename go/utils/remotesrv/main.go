@@ -19,10 +19,11 @@ import (
 	"flag"
 	"github.com/hashicorp/go-sockaddr/template"
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 	"log"
 	"net"
 	"os"
-	"os/signal"
+	"time"
 
 	"github.com/dolthub/dolt/go/libraries/doltcore/doltdb"
 	"github.com/dolthub/dolt/go/libraries/doltcore/env"
@@ -38,26 +39,65 @@ func run() error {
 	grpcAddrParam := flag.String("grpc-addr", "localhost:50051", "the address the grpc server will listen on; default localhost:50051")
 	httpAddrParam := flag.String("http-addr", "localhost:80", "the port the http server will listen on; default localhost:80; if http-port is equal to grpc-port, both services will serve over the same port")
 	httpHostParam := flag.String("http-host", "", "hostname to use in the host component of the URLs that the server generates; default ''; if '', server will echo the :authority header")
+	configParam := flag.String("config", "", "path to a YAML or TOML config file; flags override DOLT_REMOTESRV_* environment variables, which override the config file, which overrides defaults")
+	multiTenantParam := flag.Bool("multi-tenant", false, "serve many dolt repositories rooted under --dir, mapping request paths like /<org>/<repo> to each one")
+	maxOpenReposParam := flag.Int("max-open-repos", 0, "in --multi-tenant mode, the maximum number of repositories to keep loaded at once; 0 means unlimited")
+	idleTimeoutParam := flag.Duration("idle-timeout", 0, "in --multi-tenant mode, evict a repository that hasn't been accessed in this long; 0 disables idle eviction")
+	readOnlyOverridesParam := flag.String("read-only-overrides", "", "in --multi-tenant or --storage mode, path to a file of \"<repo-path> <true|false>\" lines overriding --read-only for specific repositories")
+	aclFileParam := flag.String("acl-file", "", "path to a YAML ACL file granting read/write access by identity; if unset, all requests are authorized")
+	tokenFileParam := flag.String("token-file", "", "path to a file of static bearer tokens accepted for authentication")
+	jwksURLParam := flag.String("jwks-url", "", "URL of a JWKS document used to verify bearer tokens as JWTs")
+	mtlsCAFileParam := flag.String("mtls-ca-file", "", "path to a PEM file of CA certificates trusted to sign client certificates for mutual TLS")
+	mtlsGroupsFileParam := flag.String("mtls-groups-file", "", "path to a file of \"<common-name> <group1,group2,...>\" lines assigning ACL groups to mTLS client certificate common names; only used with --mtls-ca-file")
+	adminAddrParam := flag.String("admin-addr", "", "if set, serve /metrics, /healthz, and /readyz on this address")
+	storageParam := flag.String("storage", "", "if set (e.g. s3://my-bucket/dbs), serve repos whose chunks live in S3 instead of on the local filesystem")
+	awsRegionParam := flag.String("aws-region", "", "region to use for --storage and --dynamo-table; defaults to the AWS SDK's own discovery (env, shared config, instance metadata) if unset")
+	dynamoTableParam := flag.String("dynamo-table", "", "required with --storage: DynamoDB table holding the NBS manifest's compare-and-swap row for each repo")
+	shutdownTimeoutParam := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT/SIGTERM, how long to wait for in-flight RPCs to drain before hard-stopping the server")
 	flag.Parse()
 
-	if dirParam != nil && len(*dirParam) > 0 {
-		err := os.Chdir(*dirParam)
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	cfg, err := loadConfig(config{
+		ReadOnly: *readOnlyParam,
+		RepoMode: *repoModeParam,
+		Dir:      *dirParam,
+		GrpcAddr: *grpcAddrParam,
+		HttpAddr: *httpAddrParam,
+		HttpHost: *httpHostParam,
+	}, *configParam, flagValues{
+		readOnly: readOnlyParam,
+		repoMode: repoModeParam,
+		dir:      dirParam,
+		grpcAddr: grpcAddrParam,
+		httpAddr: httpAddrParam,
+		httpHost: httpHostParam,
+	}, setFlags)
+	if err != nil {
+		return errors.Wrap(err, "load config")
+	}
+
+	if len(cfg.Dir) > 0 {
+		err := os.Chdir(cfg.Dir)
 
 		if err != nil {
-			log.Fatalln("failed to chdir to:", *dirParam, "error:", err.Error())
+			log.Fatalln("failed to chdir to:", cfg.Dir, "error:", err.Error())
 		} else {
-			log.Println("cwd set to " + *dirParam)
+			log.Println("cwd set to " + cfg.Dir)
 		}
 	} else {
 		log.Println("'dir' parameter not provided. Using the current working dir.")
 	}
 
-	grpcAddr, err := resolveIP(*grpcAddrParam)
+	grpcAddr, err := resolveIP(cfg.GrpcAddr)
 	if err != nil {
 		return errors.Wrap(err, "parse grpc addr")
 	}
 
-	httpAddr, err := resolveIP(*httpAddrParam)
+	httpAddr, err := resolveIP(cfg.HttpAddr)
 	if err != nil {
 		return errors.Wrap(err, "parse http addr")
 	}
@@ -67,27 +107,112 @@ func run() error {
 		log.Fatalln("could not get cwd path:", err.Error())
 	}
 
+	var readOnlyOverrides map[string]bool
+	if *readOnlyOverridesParam != "" {
+		readOnlyOverrides, err = loadReadOnlyOverrides(*readOnlyOverridesParam)
+		if err != nil {
+			return errors.Wrap(err, "load read-only overrides")
+		}
+	}
+
 	var dbCache remotesrv.DBCache
-	if *repoModeParam {
+	if *storageParam != "" {
+		spec, err := parseStorageSpec(*storageParam)
+		if err != nil {
+			return errors.Wrap(err, "parse storage spec")
+		}
+
+		var clients objectStoreClients
+		clients.S3, err = newS3Client(context.Background(), *awsRegionParam)
+		if err != nil {
+			return errors.Wrap(err, "create s3 client")
+		}
+		clients.DynamoDB, err = newDynamoDBClient(context.Background(), *awsRegionParam)
+		if err != nil {
+			return errors.Wrap(err, "create dynamodb client")
+		}
+
+		dbCache, err = NewObjectStoreDBCache(context.Background(), spec, *dynamoTableParam, ".dolt-remotesrv-cache", fs, clients, MultiTenantDBCacheOpts{
+			ReadOnlyOverrides: readOnlyOverrides,
+		})
+		if err != nil {
+			return errors.Wrap(err, "create object store db cache")
+		}
+	} else if *multiTenantParam {
+		dbCache = NewMultiTenantDBCache(fs, ".", MultiTenantDBCacheOpts{
+			MaxOpenRepos:      *maxOpenReposParam,
+			IdleTimeout:       *idleTimeoutParam,
+			ReadOnlyOverrides: readOnlyOverrides,
+		})
+	} else if cfg.RepoMode {
 		dEnv := env.Load(context.Background(), env.GetCurrentUserHomeDir, fs, doltdb.LocalDirDoltDB, "remotesrv")
 		if !dEnv.Valid() {
 			log.Fatalln("repo-mode failed to load repository")
 		}
 		db := doltdb.HackDatasDatabaseFromDoltDB(dEnv.DoltDB)
 		cs := datas.ChunkStoreFromDatabase(db)
-		dbCache = SingletonCSCache{cs.(remotesrv.RemoteSrvStore)}
+		dbCache = SingletonCSCache{instrumentStore("", cs.(remotesrv.RemoteSrvStore))}
 	} else {
-		dbCache = NewLocalCSCache(fs)
+		dbCache = instrumentedDBCache{NewLocalCSCache(fs)}
 	}
 
-	server, err := remotesrv.NewServer(remotesrv.ServerArgs{
-		HttpHost:       *httpHostParam,
-		HttpListenAddr: httpAddr,
-		GrpcListenAddr: grpcAddr,
-		FS:             fs,
-		DBCache:        dbCache,
-		ReadOnly:       *readOnlyParam,
+	ready := &readiness{}
+	ready.markReady()
+
+	auth, err := newAuthSettings(authParams{
+		aclFile:        *aclFileParam,
+		tokenFile:      *tokenFileParam,
+		jwksURL:        *jwksURLParam,
+		mtlsCAFile:     *mtlsCAFileParam,
+		mtlsGroupsFile: *mtlsGroupsFileParam,
 	})
+	if err != nil {
+		return errors.Wrap(err, "load auth settings")
+	}
+
+	draining := &drainState{}
+
+	serverArgs := remotesrv.ServerArgs{
+		HttpHost:           cfg.HttpHost,
+		HttpListenAddr:     httpAddr,
+		GrpcListenAddr:     grpcAddr,
+		FS:                 fs,
+		DBCache:            dbCache,
+		ReadOnly:           cfg.ReadOnly,
+		ClientCAs:          auth.clientCAs,
+		UnaryInterceptors:  []grpc.UnaryServerInterceptor{AuthnInterceptor(auth), UnaryMetricsInterceptor()},
+		StreamInterceptors: []grpc.StreamServerInterceptor{StreamAuthnInterceptor(auth), StreamMetricsInterceptor()},
+		RejectNewUploads:   instrumentRejectNewUploads(draining.isDraining),
+	}
+	// Assigned only when configured: storing a nil *ReloadableAuthorizer (etc.)
+	// directly in these interface fields would make them compare non-nil,
+	// so the zero/unauthenticated case must leave the fields untouched.
+	if auth.authorizer != nil {
+		serverArgs.Authorizer = auth.authorizer
+	}
+	if auth.tokenAuthenticator != nil {
+		serverArgs.TokenAuthenticator = auth.tokenAuthenticator
+	}
+	if auth.jwksAuthenticator != nil {
+		serverArgs.JWKSAuthenticator = auth.jwksAuthenticator
+	}
+	if auth.certCNAuthenticator != nil {
+		serverArgs.CertCNAuthenticator = auth.certCNAuthenticator
+	}
+
+	if *adminAddrParam != "" {
+		// A separate admin address was requested: serve /metrics, /healthz,
+		// and /readyz on their own listener, independent of client traffic.
+		if err := serveAdmin(*adminAddrParam, ready); err != nil {
+			return errors.Wrap(err, "start admin server")
+		}
+	} else {
+		// No admin address configured: expose the same endpoints on the
+		// main HTTP listener so they're always reachable by default.
+		serverArgs.AdminHandler = adminMux(ready)
+	}
+
+	server, err := remotesrv.NewServer(serverArgs)
 	if err != nil {
 		log.Fatalf("error creating remotesrv Server: %v\n", err)
 	}
@@ -98,8 +223,11 @@ func run() error {
 	go func() {
 		server.Serve(listeners)
 	}()
-	waitForSignal()
-	server.GracefulStop()
+
+	waitForShutdown(auth.Reload)
+
+	draining.start()
+	gracefulStop(server, *shutdownTimeoutParam)
 
 	return nil
 }
@@ -127,9 +255,3 @@ func main() {
 		log.Fatalln("error: " + err.Error())
 	}
 }
-
-func waitForSignal() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	<-c
-}
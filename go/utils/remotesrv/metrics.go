@@ -0,0 +1,237 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/remotesrv"
+	"github.com/dolthub/dolt/go/store/chunks"
+	"github.com/dolthub/dolt/go/store/hash"
+)
+
+var (
+	grpcRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dolt_remotesrv",
+		Name:      "grpc_requests_total",
+		Help:      "Total gRPC requests handled by remotesrv, by method and status.",
+	}, []string{"method", "code"})
+
+	grpcRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dolt_remotesrv",
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Latency of gRPC requests handled by remotesrv, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	chunkStoreOpsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dolt_remotesrv",
+		Name:      "chunkstore_ops_total",
+		Help:      "Total chunk store operations handled by remotesrv, by operation and repository.",
+	}, []string{"op", "repo"})
+
+	chunkStoreOpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dolt_remotesrv",
+		Name:      "chunkstore_op_duration_seconds",
+		Help:      "Latency of chunk store operations handled by remotesrv, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	chunkStoreBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dolt_remotesrv",
+		Name:      "chunkstore_bytes_total",
+		Help:      "Total bytes transferred by chunk store operations, by operation.",
+	}, []string{"op"})
+
+	rejectedUploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "dolt_remotesrv",
+		Name:      "rejected_uploads_total",
+		Help:      "Total chunk uploads refused because the server was draining for shutdown.",
+	})
+)
+
+// recordChunkStoreOp instruments a single chunk store Get/Has/Put call.
+func recordChunkStoreOp(op, repo string, bytes int, start time.Time) {
+	chunkStoreOpsTotal.WithLabelValues(op, repo).Inc()
+	chunkStoreOpDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if bytes > 0 {
+		chunkStoreBytesTotal.WithLabelValues(op).Add(float64(bytes))
+	}
+}
+
+// instrumentedStore wraps a remotesrv.RemoteSrvStore, recording metrics for
+// its Get/Has/Put calls against repo. Every other method (manifest, table
+// file, and lifecycle calls) passes through to the embedded store unchanged.
+type instrumentedStore struct {
+	remotesrv.RemoteSrvStore
+	repo string
+}
+
+// instrumentStore wraps s so its Get/Has/Put calls are recorded against
+// repo in the chunkstore_* metrics.
+func instrumentStore(repo string, s remotesrv.RemoteSrvStore) remotesrv.RemoteSrvStore {
+	return instrumentedStore{RemoteSrvStore: s, repo: repo}
+}
+
+func (s instrumentedStore) Get(ctx context.Context, h hash.Hash) (chunks.Chunk, error) {
+	start := time.Now()
+	c, err := s.RemoteSrvStore.Get(ctx, h)
+	recordChunkStoreOp("get", s.repo, len(c.Data()), start)
+	return c, err
+}
+
+func (s instrumentedStore) Has(ctx context.Context, h hash.Hash) (bool, error) {
+	start := time.Now()
+	ok, err := s.RemoteSrvStore.Has(ctx, h)
+	recordChunkStoreOp("has", s.repo, 0, start)
+	return ok, err
+}
+
+func (s instrumentedStore) Put(ctx context.Context, c chunks.Chunk, getAddrs chunks.GetAddrsCb) error {
+	start := time.Now()
+	err := s.RemoteSrvStore.Put(ctx, c, getAddrs)
+	recordChunkStoreOp("put", s.repo, len(c.Data()), start)
+	return err
+}
+
+// Close passes through to the embedded store's Close, if it has one, since
+// RemoteSrvStore itself doesn't declare Close and so embedding it alone
+// wouldn't promote one.
+func (s instrumentedStore) Close() error {
+	if c, ok := s.RemoteSrvStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// instrumentedDBCache wraps a remotesrv.DBCache, instrumenting every store
+// it returns with instrumentStore. This lets a DBCache implementation we
+// don't otherwise touch (e.g. NewLocalCSCache's default single-repo cache)
+// still report chunkstore_* metrics like every other DBCache construction
+// path does.
+type instrumentedDBCache struct {
+	remotesrv.DBCache
+}
+
+func (c instrumentedDBCache) Get(ctx context.Context, repoPath string) (remotesrv.RemoteSrvStore, error) {
+	store, err := c.DBCache.Get(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentStore(repoPath, store), nil
+}
+
+// UnaryMetricsInterceptor records request counts and latencies for unary
+// gRPC calls, labeled by method and resulting status code.
+func UnaryMetricsInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		grpcRequestsTotal.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		grpcRequestDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		return resp, err
+	}
+}
+
+// StreamMetricsInterceptor records request counts and latencies for
+// streaming gRPC calls, labeled by method and resulting status code.
+func StreamMetricsInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		grpcRequestsTotal.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		grpcRequestDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// instrumentRejectNewUploads wraps isDraining so that every refusal it
+// signals - the draining-for-shutdown check remotesrv.ServerArgs.
+// RejectNewUploads uses to decide whether to refuse a new chunk upload -
+// is counted in rejected_uploads_total, rather than a drain being
+// invisible to monitoring.
+func instrumentRejectNewUploads(isDraining func() bool) func() bool {
+	return func() bool {
+		draining := isDraining()
+		if draining {
+			rejectedUploadsTotal.Inc()
+		}
+		return draining
+	}
+}
+
+// readiness tracks whether the server has finished the startup work (most
+// importantly, initializing its DBCache) that /readyz reports on.
+type readiness struct {
+	ready atomic.Bool
+}
+
+func (r *readiness) markReady()    { r.ready.Store(true) }
+func (r *readiness) isReady() bool { return r.ready.Load() }
+
+// adminMux builds the handler serving /metrics, /healthz, and /readyz.
+func adminMux(ready *readiness) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	return mux
+}
+
+// serveAdmin starts the admin HTTP server for /metrics, /healthz, and
+// /readyz on addr, returning once the listener is bound. It serves in the
+// background and logs (rather than returns) any later error.
+func serveAdmin(addr string, ready *readiness) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: adminMux(ready)}
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.Println("admin server error:", err.Error())
+		}
+	}()
+
+	return nil
+}
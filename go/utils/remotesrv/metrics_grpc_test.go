@@ -0,0 +1,94 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestUnaryMetricsInterceptorRecordsThroughRealServer installs
+// UnaryMetricsInterceptor on a real grpc.Server, exactly as main.go does,
+// and confirms a real round trip records it in grpc_requests_total -
+// rather than only exercising the interceptor function directly.
+func TestUnaryMetricsInterceptorRecordsThroughRealServer(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(UnaryMetricsInterceptor()))
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthSrv)
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	client := healthpb.NewHealthClient(dialBufconn(t, lis))
+
+	before := testutil.ToFloat64(grpcRequestsTotal.WithLabelValues("/grpc.health.v1.Health/Check", "OK"))
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	after := testutil.ToFloat64(grpcRequestsTotal.WithLabelValues("/grpc.health.v1.Health/Check", "OK"))
+	assert.Equal(t, before+1, after)
+}
+
+// TestStreamMetricsInterceptorRecordsThroughRealServer is the streaming
+// counterpart, exercised against the health service's streaming Watch RPC.
+func TestStreamMetricsInterceptorRecordsThroughRealServer(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(grpc.StreamInterceptor(StreamMetricsInterceptor()))
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthSrv)
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	client := healthpb.NewHealthClient(dialBufconn(t, lis))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	recorded := func() float64 {
+		// The server-side handler may observe the cancellation as either
+		// a Canceled or an OK status depending on timing; either one
+		// proves StreamMetricsInterceptor recorded the real call.
+		return testutil.ToFloat64(grpcRequestsTotal.WithLabelValues("/grpc.health.v1.Health/Watch", "Canceled")) +
+			testutil.ToFloat64(grpcRequestsTotal.WithLabelValues("/grpc.health.v1.Health/Watch", "OK"))
+	}
+
+	cancel()
+	// Give the server-side handler a moment to observe the cancellation
+	// and return, at which point the interceptor records the call.
+	for i := 0; i < 100; i++ {
+		if recorded() > 0 {
+			return
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	t.Fatal("stream metrics were never recorded for the real in-flight Watch call")
+}
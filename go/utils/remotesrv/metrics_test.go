@@ -0,0 +1,161 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/remotesrv"
+	"github.com/dolthub/dolt/go/store/chunks"
+	"github.com/dolthub/dolt/go/store/hash"
+)
+
+// fakeRemoteSrvStore implements just enough of remotesrv.RemoteSrvStore for
+// instrumentStore's Get/Has/Put wrappers to be exercised directly.
+type fakeRemoteSrvStore struct {
+	remotesrv.RemoteSrvStore
+	chunk chunks.Chunk
+	has   bool
+}
+
+func (f *fakeRemoteSrvStore) Get(ctx context.Context, h hash.Hash) (chunks.Chunk, error) {
+	return f.chunk, nil
+}
+
+func (f *fakeRemoteSrvStore) Has(ctx context.Context, h hash.Hash) (bool, error) {
+	return f.has, nil
+}
+
+func (f *fakeRemoteSrvStore) Put(ctx context.Context, c chunks.Chunk, getAddrs chunks.GetAddrsCb) error {
+	return nil
+}
+
+// fakeDBCache is a remotesrv.DBCache that always returns store, regardless
+// of repoPath, so instrumentedDBCache can be tested without a real backing
+// repository.
+type fakeDBCache struct {
+	store remotesrv.RemoteSrvStore
+}
+
+func (c fakeDBCache) Get(ctx context.Context, repoPath string) (remotesrv.RemoteSrvStore, error) {
+	return c.store, nil
+}
+
+func (c fakeDBCache) IsReadOnly(repoPath string, defaultReadOnly bool) bool {
+	return defaultReadOnly
+}
+
+func TestInstrumentedDBCacheRecordsChunkStoreOps(t *testing.T) {
+	chunk := chunks.NewChunk([]byte("some-chunk-data"))
+	fake := &fakeRemoteSrvStore{chunk: chunk, has: true}
+	cache := instrumentedDBCache{fakeDBCache{store: fake}}
+
+	store, err := cache.Get(context.Background(), "someorg/somerepo")
+	assert.NoError(t, err)
+
+	before := testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("get", "someorg/somerepo"))
+
+	_, err = store.Get(context.Background(), chunk.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("get", "someorg/somerepo")))
+}
+
+func TestAdminMuxHealthz(t *testing.T) {
+	mux := adminMux(&readiness{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAdminMuxReadyz(t *testing.T) {
+	mux := adminMux(&readiness{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	ready := &readiness{}
+	ready.markReady()
+	mux = adminMux(ready)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAdminMuxMetrics(t *testing.T) {
+	mux := adminMux(&readiness{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// TestInstrumentRejectNewUploadsRecordsMetric verifies that once a server
+// starts draining, every subsequent consultation of RejectNewUploads - the
+// hook remotesrv uses to refuse a new chunk upload while in-flight ones
+// finish - shows up in rejected_uploads_total, rather than being invisible
+// to monitoring once the drain actually starts rejecting requests.
+func TestInstrumentRejectNewUploadsRecordsMetric(t *testing.T) {
+	d := &drainState{}
+	reject := instrumentRejectNewUploads(d.isDraining)
+
+	before := testutil.ToFloat64(rejectedUploadsTotal)
+
+	assert.False(t, reject(), "should not reject uploads before draining starts")
+	assert.Equal(t, before, testutil.ToFloat64(rejectedUploadsTotal))
+
+	d.start()
+
+	assert.True(t, reject(), "should reject uploads once draining starts")
+	assert.Equal(t, before+1, testutil.ToFloat64(rejectedUploadsTotal))
+}
+
+func TestInstrumentStoreRecordsChunkStoreOps(t *testing.T) {
+	chunk := chunks.NewChunk([]byte("some-chunk-data"))
+	fake := &fakeRemoteSrvStore{chunk: chunk, has: true}
+	store := instrumentStore("someorg/somerepo", fake)
+	ctx := context.Background()
+
+	getOpsBefore := testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("get", "someorg/somerepo"))
+	getBytesBefore := testutil.ToFloat64(chunkStoreBytesTotal.WithLabelValues("get"))
+
+	_, err := store.Get(ctx, chunk.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, getOpsBefore+1, testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("get", "someorg/somerepo")))
+	assert.Equal(t, getBytesBefore+float64(len(chunk.Data())), testutil.ToFloat64(chunkStoreBytesTotal.WithLabelValues("get")))
+
+	hasOpsBefore := testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("has", "someorg/somerepo"))
+
+	ok, err := store.Has(ctx, chunk.Hash())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, hasOpsBefore+1, testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("has", "someorg/somerepo")))
+
+	putOpsBefore := testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("put", "someorg/somerepo"))
+
+	err = store.Put(ctx, chunk, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, putOpsBefore+1, testutil.ToFloat64(chunkStoreOpsTotal.WithLabelValues("put", "someorg/somerepo")))
+}
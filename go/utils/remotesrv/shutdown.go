@@ -0,0 +1,81 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// gracefulStopper is the subset of remotesrv.Server that gracefulStop
+// drains and, if necessary, forcibly stops.
+type gracefulStopper interface {
+	GracefulStop()
+	Stop()
+}
+
+// drainState tracks whether the server is shutting down, so HTTP handlers
+// can reject new chunk uploads while letting in-progress ones finish.
+type drainState struct {
+	draining atomic.Bool
+}
+
+func (d *drainState) start()           { d.draining.Store(true) }
+func (d *drainState) isDraining() bool { return d.draining.Load() }
+
+// waitForShutdown blocks until SIGINT or SIGTERM is received, reloading
+// config via reload (and continuing to wait) on every SIGHUP in the
+// meantime.
+func waitForShutdown(reload func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			if err := reload(); err != nil {
+				log.Println("error reloading config on SIGHUP:", err.Error())
+			}
+			continue
+		}
+		return
+	}
+}
+
+// gracefulStop drains in-flight RPCs on server, hard-stopping it if they
+// haven't finished within timeout. A non-positive timeout waits
+// indefinitely for drain to complete.
+func gracefulStop(server gracefulStopper, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+
+	if timeout <= 0 {
+		<-done
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("shutdown timeout exceeded; forcing stop")
+		server.Stop()
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeGracefulStopper lets tests control how long GracefulStop takes, and
+// observe whether Stop was ever called.
+type fakeGracefulStopper struct {
+	gracefulStopDelay time.Duration
+	stopped           atomic.Bool
+}
+
+func (f *fakeGracefulStopper) GracefulStop() {
+	time.Sleep(f.gracefulStopDelay)
+}
+
+func (f *fakeGracefulStopper) Stop() {
+	f.stopped.Store(true)
+}
+
+func TestGracefulStopDrainsWithinTimeout(t *testing.T) {
+	f := &fakeGracefulStopper{gracefulStopDelay: 10 * time.Millisecond}
+
+	gracefulStop(f, time.Second)
+
+	assert.False(t, f.stopped.Load(), "should not hard-stop when drain finishes before the timeout")
+}
+
+func TestGracefulStopForcesAfterTimeout(t *testing.T) {
+	f := &fakeGracefulStopper{gracefulStopDelay: time.Second}
+
+	gracefulStop(f, 10*time.Millisecond)
+
+	assert.True(t, f.stopped.Load(), "should hard-stop once the timeout elapses")
+}
+
+func TestDrainState(t *testing.T) {
+	d := &drainState{}
+	assert.False(t, d.isDraining())
+
+	d.start()
+	assert.True(t, d.isDraining())
+}
+
+// dialBufconn returns a client connection to a grpc.Server listening on
+// lis, an in-process bufconn listener.
+func dialBufconn(t *testing.T, lis *bufconn.Listener) *grpc.ClientConn {
+	t.Helper()
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// TestGracefulStopDrainsInFlightGRPCCall uses a real in-process gRPC server
+// and client to verify that an in-flight streaming RPC is allowed to finish
+// before GracefulStop returns, rather than being cut off.
+func TestGracefulStopDrainsInFlightGRPCCall(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthSrv)
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	go grpcServer.Serve(lis)
+
+	client := healthpb.NewHealthClient(dialBufconn(t, lis))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	// Confirm the RPC is actually in flight on the server before draining
+	// starts.
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	streamDone := make(chan struct{})
+	go func() {
+		// Hold the call open to simulate a slow in-flight request, then
+		// let it finish on its own ahead of the drain timeout.
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		close(streamDone)
+	}()
+
+	gracefulStop(grpcServer, time.Second)
+
+	select {
+	case <-streamDone:
+	default:
+		t.Fatal("gracefulStop returned before the in-flight gRPC call finished draining")
+	}
+}
+
+// TestGracefulStopForcesStopOnRealGRPCServer verifies the timeout path
+// against a real grpc.Server: a call that never finishes gets cut off once
+// the drain timeout elapses, rather than blocking shutdown forever.
+func TestGracefulStopForcesStopOnRealGRPCServer(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthSrv)
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	go grpcServer.Serve(lis)
+
+	client := healthpb.NewHealthClient(dialBufconn(t, lis))
+
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// Never cancel the watch: it's still in flight when the timeout hits,
+	// so gracefulStop must fall back to a hard Stop rather than hang.
+	done := make(chan struct{})
+	go func() {
+		gracefulStop(grpcServer, 50*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("gracefulStop did not force-stop a server with a stuck in-flight call")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/remotesrv"
+	"github.com/dolthub/dolt/go/libraries/utils/filesys"
+	"github.com/dolthub/dolt/go/store/nbs"
+)
+
+// storageSpec is a parsed --storage flag value, e.g. "s3://my-bucket/dbs".
+// The prefix, if any, is prepended to every repo path to form the object
+// key namespace for that repo's chunks.
+type storageSpec struct {
+	Scheme string
+	Bucket string
+	Prefix string
+}
+
+// objectStoreClients bundles the SDK clients newObjectStoreChunkStore needs
+// to talk to the bucket and its manifest table.
+type objectStoreClients struct {
+	S3       *s3.Client
+	DynamoDB *dynamodb.Client
+}
+
+// newS3Client builds an S3 client using the AWS SDK's default credential
+// chain (environment, shared config, EC2/ECS role, etc.), resolving the
+// region from awsRegion if given or the SDK's own discovery otherwise.
+func newS3Client(ctx context.Context, awsRegion string) (*s3.Client, error) {
+	cfg, err := loadAWSConfig(ctx, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.NewFromConfig(cfg), nil
+}
+
+// newDynamoDBClient builds a DynamoDB client the same way newS3Client
+// builds its S3 client. The table it talks to holds, per repo, the single
+// row NBS uses to compare-and-swap the root chunk address, since S3 alone
+// has no atomic conditional-write primitive for NBS's manifest to rely on.
+func newDynamoDBClient(ctx context.Context, awsRegion string) (*dynamodb.Client, error) {
+	cfg, err := loadAWSConfig(ctx, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamodb.NewFromConfig(cfg), nil
+}
+
+func loadAWSConfig(ctx context.Context, awsRegion string) (awsconfig.Config, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if awsRegion != "" {
+		opts = append(opts, awsconfig.WithRegion(awsRegion))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return awsconfig.Config{}, errors.Wrap(err, "load aws config")
+	}
+
+	return cfg, nil
+}
+
+// parseStorageSpec parses a "s3://bucket/prefix" value, as accepted by the
+// --storage flag. Only s3 is supported: NBS's manifest needs a backing
+// store that supports atomic compare-and-swap, which object storage alone
+// doesn't provide (S3 is paired with a DynamoDB table for this; there's no
+// equivalent NBS backend for GCS).
+func parseStorageSpec(spec string) (storageSpec, error) {
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		return storageSpec{}, errors.Errorf("malformed --storage value %q; expected s3://bucket[/prefix]", spec)
+	}
+
+	if scheme != "s3" {
+		return storageSpec{}, errors.Errorf("unsupported --storage scheme %q; only s3 is supported", scheme)
+	}
+
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return storageSpec{}, errors.Errorf("malformed --storage value %q; missing bucket name", spec)
+	}
+
+	return storageSpec{Scheme: scheme, Bucket: bucket, Prefix: strings.Trim(prefix, "/")}, nil
+}
+
+// NewObjectStoreDBCache builds a DBCache that serves repositories whose
+// chunks live in the S3 bucket described by spec, rather than on the local
+// filesystem. Each repo's NBS table files are stored as immutable objects
+// under "<prefix>/<repo>/", with dynamoTable holding the CAS row NBS uses
+// to update that repo's root atomically, and localMetaDir used to cache
+// the small per-repo manifest so repeated Root/Has calls don't each
+// round-trip to the bucket.
+func NewObjectStoreDBCache(ctx context.Context, spec storageSpec, dynamoTable, localMetaDir string, fs filesys.Filesys, clients objectStoreClients, opts MultiTenantDBCacheOpts) (*MultiTenantDBCache, error) {
+	if clients.S3 == nil {
+		return nil, errors.New("s3 storage requires an S3 client")
+	}
+	if dynamoTable == "" || clients.DynamoDB == nil {
+		return nil, errors.New("s3 storage requires a DynamoDB client and --dynamo-table for the NBS manifest's compare-and-swap store")
+	}
+
+	if err := fs.MkDirs(localMetaDir); err != nil {
+		return nil, errors.Wrap(err, "create local metadata cache dir")
+	}
+
+	cache := NewMultiTenantDBCache(fs, localMetaDir, opts)
+	cache.loadRepoFunc = func(ctx context.Context, repoPath string) (remotesrv.RemoteSrvStore, error) {
+		return newObjectStoreChunkStore(ctx, spec, dynamoTable, clients, repoPath, localMetaDir)
+	}
+
+	return cache, nil
+}
+
+// newAWSStore constructs the real NBS store backed by S3 and DynamoDB.
+// It's a var so tests can substitute a fake, exercising the repo-path
+// wiring and the instrumented Get/Has/Put pass-through without a real
+// bucket or table.
+var newAWSStore = nbs.NewAWSStoreFromConfig
+
+// newObjectStoreChunkStore opens (creating if necessary) the NBS store for
+// repoPath, backed by the bucket/prefix described by spec with its
+// manifest CAS row in dynamoTable, caching the manifest locally under
+// localMetaDir/repoPath.
+func newObjectStoreChunkStore(ctx context.Context, spec storageSpec, dynamoTable string, clients objectStoreClients, repoPath, localMetaDir string) (remotesrv.RemoteSrvStore, error) {
+	key, err := normalizeRepoPath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	objPrefix := strings.Trim(spec.Prefix+"/"+key, "/")
+
+	store, err := newAWSStore(ctx, nbs.AWSStoreConfig{
+		S3:            clients.S3,
+		DynamoDB:      clients.DynamoDB,
+		Bucket:        spec.Bucket,
+		Table:         dynamoTable,
+		Prefix:        objPrefix,
+		LocalCacheDir: filepath.Join(localMetaDir, filepath.FromSlash(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return instrumentStore(key, store), nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/remotesrv"
+	"github.com/dolthub/dolt/go/store/nbs"
+)
+
+func TestParseStorageSpec(t *testing.T) {
+	spec, err := parseStorageSpec("s3://my-bucket/dbs")
+	require.NoError(t, err)
+	assert.Equal(t, storageSpec{Scheme: "s3", Bucket: "my-bucket", Prefix: "dbs"}, spec)
+
+	spec, err = parseStorageSpec("s3://my-bucket")
+	require.NoError(t, err)
+	assert.Equal(t, storageSpec{Scheme: "s3", Bucket: "my-bucket", Prefix: ""}, spec)
+}
+
+func TestParseStorageSpecErrors(t *testing.T) {
+	_, err := parseStorageSpec("my-bucket/dbs")
+	assert.Error(t, err)
+
+	_, err = parseStorageSpec("ftp://my-bucket/dbs")
+	assert.Error(t, err)
+
+	_, err = parseStorageSpec("s3:///dbs")
+	assert.Error(t, err)
+
+	// GCS isn't an NBS backend: there's no atomic compare-and-swap store
+	// wired up for it, unlike S3+DynamoDB, so --storage gs://... must be
+	// rejected rather than silently constructing a store with no manifest
+	// CAS guarantee.
+	_, err = parseStorageSpec("gs://my-bucket/dbs")
+	assert.Error(t, err)
+}
+
+func TestNewObjectStoreDBCacheRequiresDynamoTable(t *testing.T) {
+	_, err := NewObjectStoreDBCache(context.Background(), storageSpec{Scheme: "s3", Bucket: "b"}, "", t.TempDir(), nil, objectStoreClients{S3: &s3.Client{}}, MultiTenantDBCacheOpts{})
+	assert.Error(t, err)
+}
+
+func TestNewObjectStoreDBCacheRequiresS3Client(t *testing.T) {
+	_, err := NewObjectStoreDBCache(context.Background(), storageSpec{Scheme: "s3", Bucket: "b"}, "table", t.TempDir(), nil, objectStoreClients{DynamoDB: &dynamodb.Client{}}, MultiTenantDBCacheOpts{})
+	assert.Error(t, err)
+}
+
+// TestNewObjectStoreChunkStoreBuildsExpectedConfig swaps out newAWSStore for
+// a fake that records the nbs.AWSStoreConfig it was called with, and
+// returns a fake RemoteSrvStore, so the repo-path-to-object-key wiring and
+// the instrumented Get/Has/Put pass-through can be exercised against a
+// fake bucket without a real one.
+func TestNewObjectStoreChunkStoreBuildsExpectedConfig(t *testing.T) {
+	orig := newAWSStore
+	defer func() { newAWSStore = orig }()
+
+	var gotCfg nbs.AWSStoreConfig
+	fake := &fakeRemoteSrvStore{has: true}
+	newAWSStore = func(ctx context.Context, cfg nbs.AWSStoreConfig) (remotesrv.RemoteSrvStore, error) {
+		gotCfg = cfg
+		return fake, nil
+	}
+
+	clients := objectStoreClients{S3: &s3.Client{}, DynamoDB: &dynamodb.Client{}}
+	store, err := newObjectStoreChunkStore(context.Background(), storageSpec{Scheme: "s3", Bucket: "my-bucket", Prefix: "dbs"}, "my-table", clients, "/someorg/somerepo/", "/cache")
+	require.NoError(t, err)
+
+	assert.Equal(t, "dbs/someorg/somerepo", gotCfg.Prefix)
+	assert.Equal(t, "my-table", gotCfg.Table)
+	assert.Equal(t, "/cache/someorg/somerepo", gotCfg.LocalCacheDir)
+
+	// The returned store should still be instrumented, exactly like the
+	// local-filesystem loading path.
+	ok, err := store.Has(context.Background(), fake.chunk.Hash())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestNewObjectStoreChunkStoreRejectsTraversal(t *testing.T) {
+	clients := objectStoreClients{S3: &s3.Client{}, DynamoDB: &dynamodb.Client{}}
+	_, err := newObjectStoreChunkStore(context.Background(), storageSpec{Scheme: "s3", Bucket: "my-bucket"}, "my-table", clients, "../../etc", "/cache")
+	assert.Error(t, err)
+}